@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ignoredCompareHeaders lists response headers that are expected to differ
+// between two backends and should not be reported as a diff, such as
+// timestamps and per-host cache identifiers.
+var ignoredCompareHeaders = map[string]bool{
+	"Date":      true,
+	"Age":       true,
+	"X-Varnish": true,
+}
+
+// diffableBodyTypes lists the Content-Type prefixes for which a unified body
+// diff is produced. Anything else only gets a byte-length delta, since a
+// line diff of binary content is not useful.
+var diffableBodyTypes = []string{"text/", "application/json"}
+
+// compareResult holds the outcome of replaying one request against both the
+// old and new hosts in -compare mode.
+type compareResult struct {
+	match      bool
+	oldStatus  int
+	newStatus  int
+	oldElapsed time.Duration
+	newElapsed time.Duration
+	headerDiff []string
+	bodyDiff   string
+	err        error
+}
+
+// CompareRequest sends req to both old_host and new_host concurrently via
+// the shared transport's RoundTrip, and reports any differences in status
+// code, headers (other than those in ignoredCompareHeaders) and body.
+func (req *Request) CompareRequest(old_host, new_host string) *compareResult {
+
+	type roundtrip struct {
+		resp    *http.Response
+		body    []byte
+		elapsed time.Duration
+		err     error
+	}
+
+	do := func(target_host string) roundtrip {
+		req_url, err := req.GetURL(target_host)
+		if err != nil {
+			return roundtrip{err: err}
+		}
+
+		major, minor, ok := http.ParseHTTPVersion(req.Protocol)
+		if !ok {
+			return roundtrip{err: fmt.Errorf("Unknown protocol: %s\n", req.Protocol)}
+		}
+
+		http_req, err := http.NewRequest(req.Method, req_url.String(), bytes.NewReader(req.Body))
+		if err != nil {
+			return roundtrip{err: err}
+		}
+		http_req.Proto = req.Protocol
+		http_req.ProtoMajor = major
+		http_req.ProtoMinor = minor
+		http_req.Header = req.Headers.Clone()
+		http_req.Host = req.GetHost()
+		http_req.ContentLength = int64(len(req.Body))
+
+		start := time.Now()
+		resp, err := transport.RoundTrip(http_req)
+		elapsed := time.Since(start)
+		if err != nil {
+			return roundtrip{elapsed: elapsed, err: err}
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return roundtrip{resp: resp, elapsed: elapsed, err: err}
+		}
+
+		return roundtrip{resp: resp, body: body, elapsed: elapsed}
+	}
+
+	old_ch := make(chan roundtrip, 1)
+	new_ch := make(chan roundtrip, 1)
+	go func() { old_ch <- do(old_host) }()
+	go func() { new_ch <- do(new_host) }()
+	old_rt := <-old_ch
+	new_rt := <-new_ch
+
+	result := &compareResult{
+		match:      true,
+		oldElapsed: old_rt.elapsed,
+		newElapsed: new_rt.elapsed,
+	}
+
+	if old_rt.err != nil || new_rt.err != nil {
+		result.match = false
+		result.err = fmt.Errorf("old: %v, new: %v", old_rt.err, new_rt.err)
+		return result
+	}
+
+	result.oldStatus = old_rt.resp.StatusCode
+	result.newStatus = new_rt.resp.StatusCode
+	if result.oldStatus != result.newStatus {
+		result.match = false
+	}
+
+	result.headerDiff = diffHeaders(old_rt.resp.Header, new_rt.resp.Header)
+	if len(result.headerDiff) > 0 {
+		result.match = false
+	}
+
+	if !bytes.Equal(old_rt.body, new_rt.body) {
+		result.match = false
+		result.bodyDiff = diffBodies(old_rt.resp.Header.Get("Content-Type"), old_rt.body, new_rt.body)
+	}
+
+	return result
+}
+
+// diffHeaders returns a sorted list of "Header: old -> new" lines for every
+// header that differs between old and new, excluding ignoredCompareHeaders.
+func diffHeaders(old, new http.Header) []string {
+	seen := map[string]bool{}
+	var diffs []string
+
+	check := func(key string) {
+		if seen[key] || ignoredCompareHeaders[key] {
+			return
+		}
+		seen[key] = true
+		old_val := old.Get(key)
+		new_val := new.Get(key)
+		if old_val != new_val {
+			diffs = append(diffs, fmt.Sprintf("%s: %q -> %q", key, old_val, new_val))
+		}
+	}
+
+	for key := range old {
+		check(key)
+	}
+	for key := range new {
+		check(key)
+	}
+
+	sort.Strings(diffs)
+	return diffs
+}
+
+// diffBodies summarises the difference between two response bodies: a
+// byte-length delta always, plus a unified line diff when the content type
+// looks like text or JSON.
+func diffBodies(content_type string, old, new []byte) string {
+	summary := fmt.Sprintf("body length: %d -> %d (%+d bytes)", len(old), len(new), len(new)-len(old))
+
+	diffable := false
+	for _, prefix := range diffableBodyTypes {
+		if strings.HasPrefix(content_type, prefix) {
+			diffable = true
+			break
+		}
+	}
+	if !diffable {
+		return summary
+	}
+
+	return summary + "\n" + unifiedDiff(string(old), string(new))
+}
+
+// maxLCSCells bounds the size of the LCS matrix unifiedDiff is willing to
+// build, in cells (len(a_lines)+1) * (len(b_lines)+1). This runs
+// synchronously inside the per-request goroutine dispatch schedules under
+// -compare, so an unbounded matrix (capped only by a per-side line count)
+// can burn hundreds of MB and enough CPU, across -concurrency workers, to
+// distort the very latency numbers -compare is measuring. Above this budget
+// unifiedDiff falls back to firstDivergence instead.
+const maxLCSCells = 1 << 20 // ~1M cells, ~8MB for the int matrix
+
+// unifiedDiff returns a line diff between a and b. For inputs small enough
+// to stay within maxLCSCells it computes a minimal unified-style diff with
+// a straightforward longest-common-subsequence algorithm; otherwise it
+// falls back to the cheaper firstDivergence, which finds where the two
+// bodies start and stop differing without building an O(n*m) matrix.
+func unifiedDiff(a, b string) string {
+	a_lines := strings.Split(a, "\n")
+	b_lines := strings.Split(b, "\n")
+
+	if (len(a_lines)+1)*(len(b_lines)+1) > maxLCSCells {
+		return firstDivergence(a_lines, b_lines)
+	}
+
+	lcs := make([][]int, len(a_lines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b_lines)+1)
+	}
+	for i := len(a_lines) - 1; i >= 0; i-- {
+		for j := len(b_lines) - 1; j >= 0; j-- {
+			if a_lines[i] == b_lines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(a_lines) && j < len(b_lines) {
+		switch {
+		case a_lines[i] == b_lines[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&out, "-%s\n", a_lines[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+%s\n", b_lines[j])
+			j++
+		}
+	}
+	for ; i < len(a_lines); i++ {
+		fmt.Fprintf(&out, "-%s\n", a_lines[i])
+	}
+	for ; j < len(b_lines); j++ {
+		fmt.Fprintf(&out, "+%s\n", b_lines[j])
+	}
+
+	return out.String()
+}
+
+// firstDivergence reports where a_lines and b_lines start and stop
+// differing, in O(len(a_lines)+len(b_lines)) time and without allocating an
+// LCS matrix. It is not a minimal diff, just a cheap pointer to the
+// mismatch, used when the bodies are too large for unifiedDiff's full LCS.
+func firstDivergence(a_lines, b_lines []string) string {
+	prefix := 0
+	for prefix < len(a_lines) && prefix < len(b_lines) && a_lines[prefix] == b_lines[prefix] {
+		prefix++
+	}
+
+	a_end := len(a_lines)
+	b_end := len(b_lines)
+	for a_end > prefix && b_end > prefix && a_lines[a_end-1] == b_lines[b_end-1] {
+		a_end--
+		b_end--
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "(%d x %d lines too large for a full diff; showing first divergence only)\n", len(a_lines), len(b_lines))
+	fmt.Fprintf(&out, "line %d:\n", prefix+1)
+	if prefix < a_end {
+		fmt.Fprintf(&out, "-%s\n", a_lines[prefix])
+	}
+	if prefix < b_end {
+		fmt.Fprintf(&out, "+%s\n", b_lines[prefix])
+	}
+
+	return out.String()
+}
+
+// writeDiffArtifact writes the diff for a compared request to diff_dir, if
+// the request did not match, so results can be inspected after the run.
+func writeDiffArtifact(diff_dir string, seq int, req *Request, result *compareResult) {
+	if diff_dir == "" || result.match {
+		return
+	}
+
+	name := filepath.Join(diff_dir, fmt.Sprintf("%04d-%s.diff", seq, strings.ReplaceAll(req.Method, "/", "_")))
+	f, err := os.Create(name)
+	if err != nil {
+		log.Printf("failed to write diff artifact: %s\n", err)
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "%s %s\n\n", req.Method, req.Path)
+	fmt.Fprintf(f, "status: %d -> %d\n\n", result.oldStatus, result.newStatus)
+	for _, h := range result.headerDiff {
+		fmt.Fprintf(f, "%s\n", h)
+	}
+	if result.bodyDiff != "" {
+		fmt.Fprintf(f, "\n%s\n", result.bodyDiff)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDiffHeadersIgnoresConfiguredHeaders(t *testing.T) {
+	old := http.Header{"Date": {"a"}, "X-Varnish": {"1"}, "Content-Type": {"text/plain"}}
+	new := http.Header{"Date": {"b"}, "X-Varnish": {"2"}, "Content-Type": {"text/html"}}
+
+	diffs := diffHeaders(old, new)
+	if len(diffs) != 1 || !strings.Contains(diffs[0], "Content-Type") {
+		t.Fatalf("expected only a Content-Type diff, got %v", diffs)
+	}
+}
+
+func TestDiffHeadersNoDiff(t *testing.T) {
+	old := http.Header{"Content-Type": {"text/plain"}}
+	new := http.Header{"Content-Type": {"text/plain"}}
+
+	if diffs := diffHeaders(old, new); len(diffs) != 0 {
+		t.Fatalf("expected no diffs, got %v", diffs)
+	}
+}
+
+func TestDiffBodiesOnlyLengthForNonTextTypes(t *testing.T) {
+	summary := diffBodies("image/png", []byte{1, 2, 3}, []byte{1, 2, 3, 4})
+	if strings.Contains(summary, "\n") {
+		t.Fatalf("expected only a single length-delta line for a binary content type, got %q", summary)
+	}
+	if !strings.Contains(summary, "+1 bytes") {
+		t.Fatalf("expected a byte-length delta, got %q", summary)
+	}
+}
+
+func TestDiffBodiesUnifiedDiffForText(t *testing.T) {
+	summary := diffBodies("text/plain", []byte("a\nb\nc"), []byte("a\nx\nc"))
+	if !strings.Contains(summary, "-b") || !strings.Contains(summary, "+x") {
+		t.Fatalf("expected a unified diff of the changed line, got %q", summary)
+	}
+}
+
+func TestUnifiedDiffFallsBackWhenTooLarge(t *testing.T) {
+	// Force the cheap path regardless of maxLCSCells by calling it directly.
+	a := []string{"same1", "same2", "different-old", "same3"}
+	b := []string{"same1", "same2", "different-new", "same3"}
+
+	out := firstDivergence(a, b)
+	if !strings.Contains(out, "-different-old") || !strings.Contains(out, "+different-new") {
+		t.Fatalf("expected first divergence to report the mismatched line, got %q", out)
+	}
+	if !strings.Contains(out, "line 3:") {
+		t.Fatalf("expected the divergence to be reported at line 3, got %q", out)
+	}
+}
+
+func TestUnifiedDiffUsesFallbackAboveBudget(t *testing.T) {
+	// len(a_lines)+1 * len(b_lines)+1 must exceed maxLCSCells.
+	n := 1200
+	a_lines := make([]string, n)
+	b_lines := make([]string, n)
+	for i := range a_lines {
+		a_lines[i] = "line"
+		b_lines[i] = "line"
+	}
+	b_lines[n/2] = "different"
+
+	out := unifiedDiff(strings.Join(a_lines, "\n"), strings.Join(b_lines, "\n"))
+	if !strings.Contains(out, "too large for a full diff") {
+		t.Fatalf("expected the cheap fallback to be used, got %q", out)
+	}
+}
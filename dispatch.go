@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// dispatchConfig controls how parsed requests are paced and fanned out to
+// worker goroutines before being handled.
+type dispatchConfig struct {
+	concurrency int     // number of worker goroutines handling requests
+	rps         float64 // token-bucket rate limit, 0 for unlimited
+	speed       float64 // replay speed multiplier, 0 to disable inter-arrival pacing
+	maxRequests int     // stop after this many requests, 0 for unlimited
+}
+
+// dispatch reads requests from in, paces and rate-limits them according to
+// cfg, and hands each one to handle using a pool of cfg.concurrency worker
+// goroutines. It returns once in is closed (or ctx is cancelled) and every
+// in-flight call to handle has returned, so that an interrupted run still
+// logs the requests it had already started.
+func dispatch(ctx context.Context, in <-chan *Request, cfg dispatchConfig, handle func(*Request)) {
+
+	paced := paceRequests(ctx, in, cfg.speed)
+	limited := throttleRequests(ctx, paced, cfg.rps)
+	capped := capRequests(limited, cfg.maxRequests)
+
+	work := make(chan *Request, cfg.concurrency)
+	var workers sync.WaitGroup
+	for i := 0; i < cfg.concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for req := range work {
+				handle(req)
+			}
+		}()
+	}
+
+loop:
+	for {
+		select {
+		case req, ok := <-capped:
+			if !ok {
+				break loop
+			}
+			select {
+			case work <- req:
+			case <-ctx.Done():
+				break loop
+			}
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	close(work)
+	workers.Wait()
+}
+
+// paceRequests replays requests preserving the inter-arrival gaps between
+// their StartTime timestamps (as captured from varnishlog), scaled by
+// speed. A speed of 0 disables pacing entirely, sending requests as soon as
+// they arrive on in, same as before -speed existed.
+func paceRequests(ctx context.Context, in <-chan *Request, speed float64) <-chan *Request {
+	out := make(chan *Request)
+
+	go func() {
+		defer close(out)
+
+		var prev_start float64
+		for req := range in {
+			if speed > 0 && prev_start > 0 && req.StartTime > prev_start {
+				gap := time.Duration((req.StartTime - prev_start) / speed * float64(time.Second))
+				timer := time.NewTimer(gap)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+			if req.StartTime > 0 {
+				prev_start = req.StartTime
+			}
+
+			select {
+			case out <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// throttleRequests limits the rate requests are forwarded at using a
+// token-bucket limiter. An rps of 0 or less disables rate limiting.
+func throttleRequests(ctx context.Context, in <-chan *Request, rps float64) <-chan *Request {
+	if rps <= 0 {
+		return in
+	}
+
+	burst := int(rps)
+	if burst < 1 {
+		burst = 1
+	}
+	limiter := rate.NewLimiter(rate.Limit(rps), burst)
+
+	out := make(chan *Request)
+	go func() {
+		defer close(out)
+		for req := range in {
+			if err := limiter.Wait(ctx); err != nil {
+				return
+			}
+			select {
+			case out <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// capRequests forwards at most max requests from in, then stops. A max of 0
+// or less disables the cap.
+func capRequests(in <-chan *Request, max int) <-chan *Request {
+	if max <= 0 {
+		return in
+	}
+
+	out := make(chan *Request)
+	go func() {
+		defer close(out)
+		count := 0
+		for req := range in {
+			if count >= max {
+				return
+			}
+			count++
+			out <- req
+		}
+	}()
+
+	return out
+}
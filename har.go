@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The following types implement just enough of the HAR 1.2 spec
+// (http://www.softwareishard.com/blog/har-12-spec/) to describe replayed
+// request/response pairs, so results can be inspected in browser devtools
+// or diffed offline.
+type harLog struct {
+	Log harLogEntries `json:"log"`
+}
+
+type harLogEntries struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []harHeader `json:"headers"`
+	Cookies     []harCookie `json:"cookies,omitempty"`
+	QueryString []struct{}  `json:"queryString"`
+	BodySize    int64       `json:"bodySize"`
+	PostData    *harContent `json:"postData,omitempty"`
+}
+
+type harCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []harHeader `json:"headers"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harWriter is a Recorder that accumulates every replayed request/response
+// pair and writes them out as a single HAR 1.2 archive.
+type harWriter struct {
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+func newHARWriter() *harWriter {
+	return &harWriter{}
+}
+
+func (h *harWriter) Record(r RequestResult) {
+	entry := harEntry{
+		StartedDateTime: time.Now().UTC().Format(time.RFC3339),
+		Time:            float64(r.Elapsed.Milliseconds()),
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         r.Path,
+			HTTPVersion: "HTTP/1.1",
+			Headers:     toHARHeaders(r.ReqHeader),
+			BodySize:    int64(len(r.ReqBody)),
+		},
+		Response: harResponse{
+			Status:      r.StatusCode,
+			HTTPVersion: "HTTP/1.1",
+			Headers:     toHARHeaders(r.RespHeader),
+			BodySize:    r.RespBytes,
+			Content: harContent{
+				Size:     r.RespBytes,
+				MimeType: firstHeader(r.RespHeader, "Content-Type"),
+				Text:     string(r.RespBody),
+			},
+		},
+		Timings: harTimings{Wait: float64(r.Elapsed.Milliseconds())},
+	}
+	if len(r.ReqBody) > 0 {
+		entry.Request.PostData = &harContent{
+			Size:     int64(len(r.ReqBody)),
+			MimeType: firstHeader(r.ReqHeader, "Content-Type"),
+			Text:     string(r.ReqBody),
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, entry)
+}
+
+// WriteFile writes the accumulated entries to path as a HAR 1.2 document.
+func (h *harWriter) WriteFile(path string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	doc := harLog{Log: harLogEntries{
+		Version: "1.2",
+		Creator: harCreator{Name: "vlt", Version: "1"},
+		Entries: h.entries,
+	}}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+func toHARHeaders(h map[string][]string) []harHeader {
+	var out []harHeader
+	for name, values := range h {
+		for _, value := range values {
+			out = append(out, harHeader{Name: name, Value: value})
+		}
+	}
+	return out
+}
+
+func firstHeader(h map[string][]string, name string) string {
+	for k, values := range h {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// logHARWriteError logs a failure to write the HAR file; pulled out so
+// main can defer it in one line.
+func logHARWriteError(h *harWriter, path string) {
+	if err := h.WriteFile(path); err != nil {
+		log.Printf("failed to write HAR file %s: %s\n", path, err)
+	}
+}
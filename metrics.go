@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// RequestResult describes the outcome of replaying one request, and is fed
+// to every Recorder (the per-request stats line, the aggregate collector,
+// the Prometheus exporter and the HAR writer) so they don't each need to
+// re-derive it from the raw http.Request/http.Response.
+type RequestResult struct {
+	Method     string
+	Path       string
+	TargetHost string
+	StatusCode int // 0 if Err is set
+	Err        error
+	Elapsed    time.Duration
+	RespBytes  int64
+	ReqHeader  map[string][]string
+	RespHeader map[string][]string
+	ReqBody    []byte
+	RespBody   []byte
+}
+
+// Recorder is notified of every replayed request's result.
+type Recorder interface {
+	Record(RequestResult)
+}
+
+// multiRecorder fans a RequestResult out to several Recorders.
+type multiRecorder []Recorder
+
+func (m multiRecorder) Record(r RequestResult) {
+	for _, rec := range m {
+		rec.Record(r)
+	}
+}
+
+// statsCollector prints a per-request line in the configured format and
+// keeps running aggregates (count, error count, latency percentiles via an
+// HDR histogram, RPS and bytes/sec), printed periodically.
+type statsCollector struct {
+	format string // "text", "json" or "csv"
+
+	mu           sync.Mutex
+	hist         *hdrhistogram.Histogram
+	total        int64
+	errors       int64
+	bytes        int64
+	window_total int64
+	window_bytes int64
+	window_at    time.Time
+}
+
+// newStatsCollector creates a statsCollector for the given -stats-format.
+// Call Run in a goroutine to print aggregate summaries periodically.
+func newStatsCollector(format string) *statsCollector {
+	sc := &statsCollector{
+		format: format,
+		// Track latencies from 1 microsecond to 1 minute, 3 significant digits.
+		hist:      hdrhistogram.New(1, 60000000, 3),
+		window_at: time.Now(),
+	}
+	return sc
+}
+
+func (sc *statsCollector) Run(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sc.printSummary()
+		case <-stop:
+			sc.printSummary()
+			return
+		}
+	}
+}
+
+func (sc *statsCollector) Record(r RequestResult) {
+	sc.printLine(r)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.total++
+	sc.window_total++
+	if r.Err != nil {
+		sc.errors++
+	}
+	sc.bytes += r.RespBytes
+	sc.window_bytes += r.RespBytes
+	sc.hist.RecordValue(r.Elapsed.Microseconds())
+}
+
+func (sc *statsCollector) printLine(r RequestResult) {
+	switch sc.format {
+	case "json":
+		line, err := json.Marshal(map[string]interface{}{
+			"method":      r.Method,
+			"path":        r.Path,
+			"target_host": r.TargetHost,
+			"status":      r.StatusCode,
+			"error":       errString(r.Err),
+			"elapsed_ms":  r.Elapsed.Milliseconds(),
+			"resp_bytes":  r.RespBytes,
+		})
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		fmt.Println(string(line))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{
+			r.Method, r.Path, r.TargetHost,
+			fmt.Sprint(r.StatusCode), errString(r.Err),
+			fmt.Sprint(r.Elapsed.Milliseconds()), fmt.Sprint(r.RespBytes),
+		})
+		w.Flush()
+	default: // "text"
+		if r.Err != nil {
+			log.Printf("[%dms] [%s] %s %s\n", r.Elapsed.Milliseconds(), r.Err, r.Method, r.Path)
+		} else {
+			log.Printf("[%dms] [%d] %s %s\n", r.Elapsed.Milliseconds(), r.StatusCode, r.Method, r.Path)
+		}
+	}
+}
+
+func (sc *statsCollector) printSummary() {
+	sc.mu.Lock()
+	total := sc.total
+	errors := sc.errors
+	window_total := sc.window_total
+	window_bytes := sc.window_bytes
+	p50 := sc.hist.ValueAtQuantile(50)
+	p90 := sc.hist.ValueAtQuantile(90)
+	p99 := sc.hist.ValueAtQuantile(99)
+	p999 := sc.hist.ValueAtQuantile(99.9)
+	elapsed := time.Since(sc.window_at).Seconds()
+	sc.window_at = time.Now()
+	sc.window_total = 0
+	sc.window_bytes = 0
+	sc.hist.Reset()
+	sc.mu.Unlock()
+
+	rps := 0.0
+	bps := 0.0
+	if elapsed > 0 {
+		rps = float64(window_total) / elapsed
+		bps = float64(window_bytes) / elapsed
+	}
+
+	log.Printf("stats: count=%d errors=%d rps=%.1f bytes/sec=%.1f p50=%dms p90=%dms p99=%dms p99.9=%dms\n",
+		total, errors, rps, bps, p50/1000, p90/1000, p99/1000, p999/1000)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// tagSet names the varnishlog tags used to recognise the parts of an HTTP
+// request for a particular varnishlog output format. Varnish 3.x ("legacy")
+// and Varnish 4.x+ ("VSL") use different tag names for the same data, and
+// the VSL format additionally supports capturing request bodies.
+type tagSet struct {
+	method    string // tag carrying the HTTP method
+	url       string // tag carrying the request URL
+	protocol  string // tag carrying the HTTP protocol version
+	header    string // tag carrying one request header per line
+	body      string // tag carrying the client-observed request body, "" if unsupported
+	bereqBody string // tag carrying the backend-observed (VCL-mutated) request body, "" if unsupported
+	end       string // tag marking the end of a request transaction
+	timestamp string // tag carrying request timing, "" if unsupported
+	grouped   bool   // true if varnishlog should be run with "-g request"
+}
+
+var legacyTags = tagSet{
+	method:    "RxRequest",
+	url:       "RxURL",
+	protocol:  "RxProtocol",
+	header:    "RxHeader",
+	body:      "",
+	bereqBody: "",
+	end:       "ReqEnd",
+	timestamp: "",
+	grouped:   false,
+}
+
+var vslTags = tagSet{
+	method:    "ReqMethod",
+	url:       "ReqURL",
+	protocol:  "ReqProtocol",
+	header:    "ReqHeader",
+	body:      "ReqBody",
+	bereqBody: "BereqBody",
+	end:       "End",
+	timestamp: "Timestamp",
+	grouped:   true,
+}
+
+// legacyLogLineRe matches a single line of ungrouped varnishlog output, as
+// produced without "-g request" (the legacy tag set always runs this way):
+//
+//	270 RxRequest    c GET
+//
+// Each line is a VXID, a tag, a client/backend marker, then the tag's value.
+// Splitting on this shape replaces the old hard-coded LOG_KEY_START/
+// LOG_KEY_END column offsets, which only held for Varnish 3.x.
+var legacyLogLineRe = regexp.MustCompile(`^\s*(\d+)\s+(\S+)\s+[cb]\s?(.*)$`)
+
+// groupedLogLineRe matches a single per-transaction line of "-g request"
+// grouped varnishlog output, as used by the VSL tag set. Each transaction is
+// introduced by a "*   << Request >> <vxid>" header line (ignored here,
+// since it doesn't start with "-") and its members are indented with a "-"
+// prefix instead of a VXID and client/backend marker:
+//
+//   - << Request  >> 32769
+//   - ReqMethod      GET
+//   - ReqHeader      Host: localhost
+var groupedLogLineRe = regexp.MustCompile(`^-\s+(\S+)\s*(.*)$`)
+
+// parseLogLine extracts a tag and its value from one line of varnishlog
+// output, using the line shape that matches format.grouped, and reports
+// whether the line matched at all (group header lines and anything else
+// that doesn't fit the shape do not).
+func parseLogLine(line string, format tagSet) (tag, value string, ok bool) {
+	if format.grouped {
+		match := groupedLogLineRe.FindStringSubmatch(line)
+		if match == nil {
+			return "", "", false
+		}
+		return match[1], match[2], true
+	}
+
+	match := legacyLogLineRe.FindStringSubmatch(line)
+	if match == nil {
+		return "", "", false
+	}
+	return match[2], match[3], true
+}
+
+// Request holds the pieces of a single HTTP request that was captured from
+// varnishlog, ready to be replayed against a target host.
+type Request struct {
+	Method    string
+	Path      string
+	Protocol  string
+	Headers   *http.Header
+	Body      []byte
+	StartTime float64 // unix time the request started, 0 if unknown
+
+	// hasReqBody records whether Body was populated from the client-observed
+	// ReqBody tag, so a later BereqBody chunk (the VCL-mutated backend body)
+	// doesn't overwrite it; see AddBodyChunk/AddBereqBodyChunk.
+	hasReqBody bool
+}
+
+func NewRequest() *Request {
+	return &Request{
+		Headers: &http.Header{},
+	}
+}
+
+func (req *Request) AddHeader(str string) {
+	header := strings.SplitN(str, ":", 2)
+	key := strings.TrimSpace(header[0])
+	value := strings.TrimSpace(header[1])
+	req.Headers.Add(key, value)
+}
+
+// AddBodyChunk decodes one line of ReqBody output (whitespace separated hex
+// bytes) and appends the result to the request body. ReqBody is the body the
+// client actually sent, so it takes priority over BereqBody; see
+// AddBereqBodyChunk.
+func (req *Request) AddBodyChunk(str string) {
+	chunk, err := decodeBodyChunk(str)
+	if err != nil {
+		return
+	}
+	req.Body = append(req.Body, chunk...)
+	req.hasReqBody = true
+}
+
+// AddBereqBodyChunk decodes one line of BereqBody output the same way as
+// AddBodyChunk, but only appends it if no ReqBody chunks have been seen for
+// this request. BereqBody reflects the request as VCL forwarded it to the
+// backend, which can differ from what the client sent (e.g. vcl_backend_fetch
+// rewrites); it's only used as a fallback for captures where ReqBody wasn't
+// requested from varnishlog or didn't fire, so POST/PUT bodies aren't
+// silently dropped.
+func (req *Request) AddBereqBodyChunk(str string) {
+	if req.hasReqBody {
+		return
+	}
+	chunk, err := decodeBodyChunk(str)
+	if err != nil {
+		return
+	}
+	req.Body = append(req.Body, chunk...)
+}
+
+// decodeBodyChunk decodes one line of ReqBody/BereqBody output, which is
+// whitespace separated hex bytes.
+func decodeBodyChunk(str string) ([]byte, error) {
+	chunk, err := hex.DecodeString(strings.ReplaceAll(str, " ", ""))
+	if err != nil {
+		log.Printf("failed to decode request body chunk: %s\n", err)
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// setStartTimeFromTimestamp extracts the request's start time from a VSL
+// Timestamp tag's value and stores it in req.StartTime. varnishlog emits
+// one Timestamp line per subtag (Start, Req, Process, Fetch, Resp, ...) in
+// chronological order, each looking like "<Subtag>: <abs> <since_start>
+// <since_last>". Only the "Req:" subtag marks when the request actually
+// arrived, so every other subtag is ignored here; otherwise the last one
+// seen before End (typically Resp:) would clobber req.StartTime with the
+// response-completion time instead of the request-arrival time.
+func (req *Request) setStartTimeFromTimestamp(value string) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 || fields[0] != "Req:" {
+		return
+	}
+	if t, err := strconv.ParseFloat(fields[1], 64); err == nil {
+		req.StartTime = t
+	}
+}
+
+// setStartTimeFromReqEnd extracts the request's start time from a legacy
+// ReqEnd tag's value ("<xid> <t_start> <t_end> <t_resp> <t_total> <t_last>")
+// and stores it in req.StartTime.
+func (req *Request) setStartTimeFromReqEnd(value string) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return
+	}
+	if t, err := strconv.ParseFloat(fields[1], 64); err == nil {
+		req.StartTime = t
+	}
+}
+
+func (req *Request) GetHost() string {
+	return strings.TrimSpace(req.Headers.Get("Host"))
+}
+
+func (req *Request) GetURL(target_host string) (*url.URL, error) {
+
+	req_url, err := url.Parse(req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Protocol[0:4] == "HTTP" {
+		if len(req.Protocol) >= 5 && req.Protocol[4:5] == "S" {
+			req_url.Scheme = "https"
+		} else {
+			req_url.Scheme = "http"
+		}
+	} else {
+		err := fmt.Errorf("Unknown scheme: %s\n", req.Protocol)
+		return nil, err
+	}
+
+	req_url.Host = target_host
+
+	return req_url, nil
+}
+
+// detectVarnishFormat runs "varnishlog -V" and picks the tag set to use
+// based on the reported version. Varnish 3.x is the only release that uses
+// the RxRequest/RxURL/RxHeader/ReqEnd tags; 4.x and later all use the VSL
+// tags with "-g request" grouping, so anything we fail to parse a version
+// number for is assumed to be modern.
+func detectVarnishFormat() tagSet {
+	out, err := exec.Command("varnishlog", "-V").CombinedOutput()
+	if err != nil {
+		log.Printf("could not run \"varnishlog -V\": %s\n", err)
+		return vslTags
+	}
+
+	match := regexp.MustCompile(`varnish-(\d+)\.`).FindSubmatch(out)
+	if match == nil {
+		return vslTags
+	}
+
+	if string(match[1]) == "3" {
+		return legacyTags
+	}
+	return vslTags
+}
+
+func varnishlog(format tagSet) io.ReadCloser {
+	// Runs a varnishlog process and returns a stdout pipe for reading.
+
+	tags := []string{format.method, format.url, format.protocol, format.header, format.end}
+	if format.body != "" {
+		tags = append(tags, format.body)
+	}
+	if format.bereqBody != "" {
+		tags = append(tags, format.bereqBody)
+	}
+	if format.timestamp != "" {
+		tags = append(tags, format.timestamp)
+	}
+
+	args := []string{"-c", "-u"}
+	if format.grouped {
+		args = append(args, "-g", "request")
+	} else {
+		args = append(args, "-o")
+	}
+	args = append(args, "-i", strings.Join(tags, ","))
+
+	cmd := exec.Command("varnishlog", args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	return stdout
+}
+
+// readRequests scans varnishlog output according to format and sends a
+// *Request to requests for every completed transaction.
+func readRequests(log_stdout io.Reader, format tagSet, requests chan<- *Request) error {
+
+	log_scanner := bufio.NewScanner(log_stdout)
+
+	req := NewRequest()
+	for log_scanner.Scan() {
+		line := log_scanner.Text()
+
+		tag, value, ok := parseLogLine(line, format)
+		if !ok {
+			continue
+		}
+
+		switch tag {
+		case format.method:
+			req = NewRequest()
+			req.Method = value
+		case format.url:
+			req.Path = value
+		case format.protocol:
+			req.Protocol = value
+		case format.header:
+			req.AddHeader(value)
+		case format.body:
+			req.AddBodyChunk(value)
+		case format.bereqBody:
+			req.AddBereqBodyChunk(value)
+		case format.timestamp:
+			req.setStartTimeFromTimestamp(value)
+		case format.end:
+			if format.timestamp == "" {
+				req.setStartTimeFromReqEnd(value)
+			}
+			requests <- req
+		}
+	}
+
+	return log_scanner.Err()
+}
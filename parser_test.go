@@ -0,0 +1,181 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLogLineGrouped(t *testing.T) {
+	cases := []struct {
+		name      string
+		line      string
+		wantOK    bool
+		wantTag   string
+		wantValue string
+	}{
+		{"group header is ignored", "*   << Request  >> 32769", false, "", ""},
+		{"member line", "-   ReqMethod      GET", true, "ReqMethod", "GET"},
+		{"member line with colon value", "-   ReqHeader      Host: localhost", true, "ReqHeader", "Host: localhost"},
+		{"member line with no value", "-   End", true, "End", ""},
+		{"blank line is ignored", "", false, "", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tag, value, ok := parseLogLine(c.line, vslTags)
+			if ok != c.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, c.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if tag != c.wantTag || value != c.wantValue {
+				t.Errorf("got (%q, %q), want (%q, %q)", tag, value, c.wantTag, c.wantValue)
+			}
+		})
+	}
+}
+
+func TestParseLogLineLegacy(t *testing.T) {
+	tag, value, ok := parseLogLine("270 RxRequest    c GET", legacyTags)
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	if tag != "RxRequest" || value != "GET" {
+		t.Errorf("got (%q, %q), want (%q, %q)", tag, value, "RxRequest", "GET")
+	}
+
+	if _, _, ok := parseLogLine("-   ReqMethod      GET", legacyTags); ok {
+		t.Error("expected a grouped-format line not to match the legacy shape")
+	}
+}
+
+// groupedSample is a representative "varnishlog -g request" transcript: a
+// group header line (ignored) followed by "-"-prefixed, unindented-VXID
+// member lines, for two separate request transactions.
+const groupedSample = `*   << Request  >> 32769
+-   Begin          req 32768 rxreq
+-   Timestamp      Start: 1466768501.612514 0.000000 0.000000
+-   ReqMethod      GET
+-   ReqURL         /
+-   ReqProtocol    HTTP/1.1
+-   ReqHeader      Host: localhost
+-   ReqHeader      User-Agent: curl/7.35.0
+-   Timestamp      Req: 1466768501.612514 0.000000 0.000000
+-   VCL_call       RECV
+-   Timestamp      Resp: 1466768501.612664 0.000150 0.000061
+-   End
+*   << Request  >> 32770
+-   Begin          req 32769 rxreq
+-   Timestamp      Start: 1466768502.712514 0.000000 0.000000
+-   ReqMethod      POST
+-   ReqURL         /submit
+-   ReqProtocol    HTTP/1.1
+-   ReqHeader      Host: localhost
+-   ReqBody        68 65 6c 6c 6f
+-   Timestamp      Req: 1466768502.712514 0.000000 0.000000
+-   Timestamp      Resp: 1466768502.712999 0.000485 0.000485
+-   End
+`
+
+func TestReadRequestsGroupedFormat(t *testing.T) {
+	requests := make(chan *Request, 2)
+	if err := readRequests(strings.NewReader(groupedSample), vslTags, requests); err != nil {
+		t.Fatalf("readRequests returned an error: %s", err)
+	}
+	close(requests)
+
+	var got []*Request
+	for req := range requests {
+		got = append(got, req)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, want 2", len(got))
+	}
+
+	if got[0].Method != "GET" || got[0].Path != "/" {
+		t.Errorf("request 0 = %s %s, want GET /", got[0].Method, got[0].Path)
+	}
+	if got[0].Headers.Get("Host") != "localhost" {
+		t.Errorf("request 0 Host = %q, want %q", got[0].Headers.Get("Host"), "localhost")
+	}
+	if got[0].StartTime != 1466768501.612514 {
+		t.Errorf("request 0 StartTime = %v, want %v", got[0].StartTime, 1466768501.612514)
+	}
+
+	if got[1].Method != "POST" || got[1].Path != "/submit" {
+		t.Errorf("request 1 = %s %s, want POST /submit", got[1].Method, got[1].Path)
+	}
+	if string(got[1].Body) != "hello" {
+		t.Errorf("request 1 Body = %q, want %q", got[1].Body, "hello")
+	}
+}
+
+func TestSetStartTimeFromTimestamp(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+		want  float64
+	}{
+		{"req subtag sets start time", "Req: 1401232289.094973 0.000000 0.000000", 1401232289.094973},
+		{"start subtag ignored", "Start: 1401232289.000000 0.000000 0.000000", 0},
+		{"process subtag ignored", "Process: 1401232289.100000 0.005027 0.005027", 0},
+		{"resp subtag ignored", "Resp: 1401232289.121249 0.026276 0.021249", 0},
+		{"malformed value ignored", "Req:", 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := NewRequest()
+			req.setStartTimeFromTimestamp(c.value)
+			if req.StartTime != c.want {
+				t.Errorf("StartTime = %v, want %v", req.StartTime, c.want)
+			}
+		})
+	}
+}
+
+func TestSetStartTimeFromTimestampDoesNotClobberEarlierReq(t *testing.T) {
+	// Timestamp lines arrive in chronological order (Start, Req, Process,
+	// Fetch, Resp, ...); only the first "Req:" value should stick.
+	req := NewRequest()
+	req.setStartTimeFromTimestamp("Start: 1401232289.000000 0.000000 0.000000")
+	req.setStartTimeFromTimestamp("Req: 1401232289.094973 0.094973 0.094973")
+	req.setStartTimeFromTimestamp("Process: 1401232289.100000 0.100000 0.005027")
+	req.setStartTimeFromTimestamp("Resp: 1401232289.121249 0.121249 0.021249")
+
+	want := 1401232289.094973
+	if req.StartTime != want {
+		t.Errorf("StartTime = %v, want %v (the Req: timestamp)", req.StartTime, want)
+	}
+}
+
+func TestAddBereqBodyChunkFallsBackWhenNoReqBody(t *testing.T) {
+	req := NewRequest()
+	req.AddBereqBodyChunk("68 65 6c 6c 6f") // "hello"
+
+	if string(req.Body) != "hello" {
+		t.Errorf("Body = %q, want %q", req.Body, "hello")
+	}
+}
+
+func TestAddBereqBodyChunkIgnoredWhenReqBodyPresent(t *testing.T) {
+	req := NewRequest()
+	req.AddBodyChunk("68 65 6c 6c 6f")      // "hello"
+	req.AddBereqBodyChunk("62 79 65 21 21") // "bye!!"
+
+	if string(req.Body) != "hello" {
+		t.Errorf("Body = %q, want %q (ReqBody should win)", req.Body, "hello")
+	}
+}
+
+func TestSetStartTimeFromReqEnd(t *testing.T) {
+	req := NewRequest()
+	req.setStartTimeFromReqEnd("1933456148 1401232289.094973087 1401232289.121248960 0.000027418 0.026240110 0.000035763")
+
+	want := 1401232289.094973087
+	if req.StartTime != want {
+		t.Errorf("StartTime = %v, want %v", req.StartTime, want)
+	}
+}
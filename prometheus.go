@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// latencyBucketsMs are the histogram bucket boundaries (in milliseconds)
+// exposed for vlt_request_duration_milliseconds.
+var latencyBucketsMs = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// metricKey identifies one label combination: method, status class (e.g.
+// "2xx") and target host.
+type metricKey struct {
+	method      string
+	statusClass string
+	targetHost  string
+}
+
+// prometheusExporter is a Recorder that keeps in-memory counters and a
+// latency histogram per label combination, and serves them on -metrics-addr
+// in the Prometheus text exposition format.
+type prometheusExporter struct {
+	mu      sync.Mutex
+	count   map[metricKey]int64
+	errors  map[metricKey]int64
+	bytes   map[metricKey]int64
+	buckets map[metricKey][]int64 // cumulative counts, one per latencyBucketsMs entry
+	sum     map[metricKey]float64
+}
+
+func newPrometheusExporter() *prometheusExporter {
+	return &prometheusExporter{
+		count:   map[metricKey]int64{},
+		errors:  map[metricKey]int64{},
+		bytes:   map[metricKey]int64{},
+		buckets: map[metricKey][]int64{},
+		sum:     map[metricKey]float64{},
+	}
+}
+
+func statusClass(status int) string {
+	if status <= 0 {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+func (p *prometheusExporter) Record(r RequestResult) {
+	key := metricKey{method: r.Method, statusClass: statusClass(r.StatusCode), targetHost: r.TargetHost}
+	ms := float64(r.Elapsed.Milliseconds())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.count[key]++
+	if r.Err != nil {
+		p.errors[key]++
+	}
+	p.bytes[key] += r.RespBytes
+	p.sum[key] += ms
+
+	buckets, ok := p.buckets[key]
+	if !ok {
+		buckets = make([]int64, len(latencyBucketsMs))
+		p.buckets[key] = buckets
+	}
+	for i, le := range latencyBucketsMs {
+		if ms <= le {
+			buckets[i]++
+		}
+	}
+}
+
+// ServeHTTP renders all counters and histograms in the Prometheus text
+// exposition format.
+func (p *prometheusExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var keys []metricKey
+	for key := range p.count {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+
+	fmt.Fprintln(w, "# HELP vlt_requests_total Total number of replayed requests.")
+	fmt.Fprintln(w, "# TYPE vlt_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "vlt_requests_total{%s} %d\n", labels(key), p.count[key])
+	}
+
+	fmt.Fprintln(w, "# HELP vlt_request_errors_total Total number of requests that failed to get a response.")
+	fmt.Fprintln(w, "# TYPE vlt_request_errors_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "vlt_request_errors_total{%s} %d\n", labels(key), p.errors[key])
+	}
+
+	fmt.Fprintln(w, "# HELP vlt_response_bytes_total Total bytes received in responses.")
+	fmt.Fprintln(w, "# TYPE vlt_response_bytes_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "vlt_response_bytes_total{%s} %d\n", labels(key), p.bytes[key])
+	}
+
+	fmt.Fprintln(w, "# HELP vlt_request_duration_milliseconds Request latency.")
+	fmt.Fprintln(w, "# TYPE vlt_request_duration_milliseconds histogram")
+	for _, key := range keys {
+		buckets := p.buckets[key]
+		for i, le := range latencyBucketsMs {
+			fmt.Fprintf(w, "vlt_request_duration_milliseconds_bucket{%s,le=\"%s\"} %d\n",
+				labels(key), strconv.FormatFloat(le, 'f', -1, 64), buckets[i])
+		}
+		fmt.Fprintf(w, "vlt_request_duration_milliseconds_bucket{%s,le=\"+Inf\"} %d\n", labels(key), p.count[key])
+		fmt.Fprintf(w, "vlt_request_duration_milliseconds_sum{%s} %f\n", labels(key), p.sum[key])
+		fmt.Fprintf(w, "vlt_request_duration_milliseconds_count{%s} %d\n", labels(key), p.count[key])
+	}
+}
+
+func labels(key metricKey) string {
+	return fmt.Sprintf("method=%q,status=%q,target_host=%q", key.method, key.statusClass, key.targetHost)
+}
+
+// serveMetrics starts the Prometheus /metrics endpoint on addr in the
+// background and returns the exporter to record results into.
+func serveMetrics(addr string) *prometheusExporter {
+	exporter := newPrometheusExporter()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("metrics server stopped: %s\n", err)
+		}
+	}()
+
+	return exporter
+}
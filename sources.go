@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RequestSource produces a stream of requests to replay. The varnishlog
+// process used to be the only way vlt got its requests; RequestSource lets
+// it be one implementation among several, so captured traffic can be
+// replayed from a file without a live Varnish, or sourced from other tools
+// entirely.
+type RequestSource interface {
+	// Requests returns a channel of parsed requests, closed once the
+	// source is exhausted.
+	Requests() <-chan *Request
+}
+
+// varnishSource runs varnishlog live and parses its output, same as vlt has
+// always done.
+type varnishSource struct {
+	format tagSet
+}
+
+func newVarnishSource(format tagSet) *varnishSource {
+	return &varnishSource{format: format}
+}
+
+func (s *varnishSource) Requests() <-chan *Request {
+	requests := make(chan *Request)
+	go func() {
+		defer close(requests)
+		log_stdout := varnishlog(s.format)
+		if err := readRequests(log_stdout, s.format, requests); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return requests
+}
+
+// fileSource replays a previously captured varnishlog dump from disk,
+// using the same tag parsing as the live source.
+type fileSource struct {
+	path   string
+	format tagSet
+}
+
+func newFileSource(path string, format tagSet) *fileSource {
+	return &fileSource{path: path, format: format}
+}
+
+func (s *fileSource) Requests() <-chan *Request {
+	requests := make(chan *Request)
+	go func() {
+		defer close(requests)
+		f, err := os.Open(s.path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if err := readRequests(f, s.format, requests); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return requests
+}
+
+// clfRe matches an NCSA Common/Combined Log Format line:
+//
+//	127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://ref/" "Mozilla/4.08"
+var clfRe = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "([^"]*)" (\d{3}) (\S+)(?: "([^"]*)" "([^"]*)")?`)
+
+// clfSource replays requests reconstructed from an NCSA Common or Combined
+// Log Format access log, such as one produced by nginx or Apache. This
+// decouples replay from Varnish being installed at all on the capture host.
+type clfSource struct {
+	path string
+}
+
+func newCLFSource(path string) *clfSource {
+	return &clfSource{path: path}
+}
+
+func (s *clfSource) Requests() <-chan *Request {
+	requests := make(chan *Request)
+	go func() {
+		defer close(requests)
+		f, err := os.Open(s.path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			req, err := parseCLFLine(scanner.Text())
+			if err != nil {
+				log.Printf("skipping unparseable log line: %s\n", err)
+				continue
+			}
+			requests <- req
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return requests
+}
+
+func parseCLFLine(line string) (*Request, error) {
+	match := clfRe.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("does not match Common/Combined Log Format: %q", line)
+	}
+	request_line, referer, user_agent := match[5], match[8], match[9]
+
+	parts := strings.Fields(request_line)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("unparseable request line: %q", request_line)
+	}
+
+	req := NewRequest()
+	req.Method = parts[0]
+	req.Path = parts[1]
+	req.Protocol = parts[2]
+
+	// NCSA logs don't record the Host header the client sent, so Host is
+	// left unset here; GetURL/SendRequest then fall back to the -input
+	// replay target, same as a request with no Host header ever would.
+	if referer != "" && referer != "-" {
+		req.Headers.Set("Referer", referer)
+	}
+	if user_agent != "" && user_agent != "-" {
+		req.Headers.Set("User-Agent", user_agent)
+	}
+
+	return req, nil
+}
+
+// harSource replays requests from a HAR 1.2 archive, such as one exported
+// from browser devtools or written by vlt's own -har flag, including
+// bodies and cookies.
+type harSource struct {
+	path string
+}
+
+func newHARSource(path string) *harSource {
+	return &harSource{path: path}
+}
+
+func (s *harSource) Requests() <-chan *Request {
+	requests := make(chan *Request)
+	go func() {
+		defer close(requests)
+
+		f, err := os.Open(s.path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		var doc harLog
+		if err := json.NewDecoder(f).Decode(&doc); err != nil {
+			log.Fatal(err)
+		}
+
+		for _, entry := range doc.Log.Entries {
+			requests <- harEntryToRequest(entry)
+		}
+	}()
+	return requests
+}
+
+func harEntryToRequest(entry harEntry) *Request {
+	req := NewRequest()
+	req.Protocol = entry.Request.HTTPVersion
+	req.Method = entry.Request.Method
+
+	if req_url, err := url.Parse(entry.Request.URL); err == nil {
+		req.Path = req_url.RequestURI()
+		if req_url.Host != "" {
+			req.Headers.Set("Host", req_url.Host)
+		}
+	} else {
+		req.Path = entry.Request.URL
+	}
+
+	for _, h := range entry.Request.Headers {
+		req.Headers.Add(h.Name, h.Value)
+	}
+
+	if len(entry.Request.Cookies) > 0 && req.Headers.Get("Cookie") == "" {
+		var pairs []string
+		for _, c := range entry.Request.Cookies {
+			pairs = append(pairs, c.Name+"="+c.Value)
+		}
+		req.Headers.Set("Cookie", strings.Join(pairs, "; "))
+	}
+
+	if entry.Request.PostData != nil {
+		req.Body = []byte(entry.Request.PostData.Text)
+	}
+
+	if t, err := time.Parse(time.RFC3339, entry.StartedDateTime); err == nil {
+		req.StartTime = float64(t.UnixNano()) / float64(time.Second)
+	}
+
+	return req
+}
+
+// detectFileVarnishFormat sniffs a captured varnishlog dump for its tag set,
+// rather than running "varnishlog -V" as detectVarnishFormat does, since the
+// whole point of replaying from a file is to not require Varnish to be
+// installed on the replay host.
+func detectFileVarnishFormat(path string) tagSet {
+	f, err := os.Open(path)
+	if err != nil {
+		return vslTags
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := legacyLogLineRe.FindStringSubmatch(line); match != nil {
+			if match[2] == legacyTags.method {
+				return legacyTags
+			}
+			if match[2] == vslTags.method {
+				return vslTags
+			}
+			continue
+		}
+		if match := groupedLogLineRe.FindStringSubmatch(line); match != nil && match[1] == vslTags.method {
+			return vslTags
+		}
+	}
+
+	return vslTags
+}
+
+// detectInputFormat picks a RequestSource implementation for a -input file
+// based on its extension, falling back to sniffing the first line for the
+// varnishlog line shape before assuming Common/Combined Log Format.
+func detectInputFormat(path string) string {
+	if strings.HasSuffix(path, ".har") {
+		return "har"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "clf"
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if legacyLogLineRe.MatchString(line) || groupedLogLineRe.MatchString(line) {
+			return "varnishlog"
+		}
+		return "clf"
+	}
+
+	return "clf"
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCLFLine(t *testing.T) {
+	cases := []struct {
+		name    string
+		line    string
+		wantErr bool
+		method  string
+		path    string
+		proto   string
+		referer string
+		ua      string
+	}{
+		{
+			name:    "combined log format",
+			line:    `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://ref/" "Mozilla/4.08"`,
+			method:  "GET",
+			path:    "/apache_pb.gif",
+			proto:   "HTTP/1.0",
+			referer: "http://ref/",
+			ua:      "Mozilla/4.08",
+		},
+		{
+			name:   "common log format without referer/user-agent",
+			line:   `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+			method: "GET",
+			path:   "/apache_pb.gif",
+			proto:  "HTTP/1.0",
+		},
+		{
+			name:   "dash referer and user-agent are dropped",
+			line:   `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "-" "-"`,
+			method: "GET",
+			path:   "/apache_pb.gif",
+			proto:  "HTTP/1.0",
+		},
+		{
+			name:    "unparseable line",
+			line:    "not a log line",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := parseCLFLine(c.line)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got request %+v", req)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if req.Method != c.method {
+				t.Errorf("Method = %q, want %q", req.Method, c.method)
+			}
+			if req.Path != c.path {
+				t.Errorf("Path = %q, want %q", req.Path, c.path)
+			}
+			if req.Protocol != c.proto {
+				t.Errorf("Protocol = %q, want %q", req.Protocol, c.proto)
+			}
+			if got := req.Headers.Get("Host"); got != "" {
+				t.Errorf("Host header = %q, want unset (CLF doesn't record the client's Host header)", got)
+			}
+			if got := req.Headers.Get("Referer"); got != c.referer {
+				t.Errorf("Referer header = %q, want %q", got, c.referer)
+			}
+			if got := req.Headers.Get("User-Agent"); got != c.ua {
+				t.Errorf("User-Agent header = %q, want %q", got, c.ua)
+			}
+		})
+	}
+}
+
+func TestHAREntryToRequest(t *testing.T) {
+	entry := harEntry{
+		StartedDateTime: "2021-01-02T03:04:05Z",
+		Request: harRequest{
+			Method:      "POST",
+			URL:         "https://example.com/submit?a=1",
+			HTTPVersion: "HTTP/1.1",
+			Headers:     []harHeader{{Name: "Accept", Value: "application/json"}},
+			Cookies:     []harCookie{{Name: "sid", Value: "abc"}},
+			PostData:    &harContent{Text: `{"ok":true}`},
+		},
+	}
+
+	req := harEntryToRequest(entry)
+
+	if req.Method != "POST" {
+		t.Errorf("Method = %q, want %q", req.Method, "POST")
+	}
+	if req.Path != "/submit?a=1" {
+		t.Errorf("Path = %q, want %q", req.Path, "/submit?a=1")
+	}
+	if req.Protocol != "HTTP/1.1" {
+		t.Errorf("Protocol = %q, want %q", req.Protocol, "HTTP/1.1")
+	}
+	if got := req.Headers.Get("Host"); got != "example.com" {
+		t.Errorf("Host header = %q, want %q", got, "example.com")
+	}
+	if got := req.Headers.Get("Accept"); got != "application/json" {
+		t.Errorf("Accept header = %q, want %q", got, "application/json")
+	}
+	if got := req.Headers.Get("Cookie"); got != "sid=abc" {
+		t.Errorf("Cookie header = %q, want %q", got, "sid=abc")
+	}
+	if string(req.Body) != `{"ok":true}` {
+		t.Errorf("Body = %q, want %q", req.Body, `{"ok":true}`)
+	}
+	if req.StartTime == 0 {
+		t.Errorf("StartTime = 0, want the parsed StartedDateTime")
+	}
+}
+
+func TestHAREntryToRequestExistingCookieHeaderWins(t *testing.T) {
+	entry := harEntry{
+		Request: harRequest{
+			Method:      "GET",
+			URL:         "/",
+			HTTPVersion: "HTTP/1.1",
+			Headers:     []harHeader{{Name: "Cookie", Value: "explicit=1"}},
+			Cookies:     []harCookie{{Name: "sid", Value: "abc"}},
+		},
+	}
+
+	req := harEntryToRequest(entry)
+
+	if got := req.Headers.Get("Cookie"); got != "explicit=1" {
+		t.Errorf("Cookie header = %q, want %q (the explicit header should win)", got, "explicit=1")
+	}
+}
+
+func TestDetectInputFormat(t *testing.T) {
+	dir := t.TempDir()
+
+	harPath := filepath.Join(dir, "capture.har")
+	if err := os.WriteFile(harPath, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := detectInputFormat(harPath); got != "har" {
+		t.Errorf("detectInputFormat(%q) = %q, want %q", harPath, got, "har")
+	}
+
+	varnishPath := filepath.Join(dir, "capture.log")
+	if err := os.WriteFile(varnishPath, []byte("270 ReqMethod    c GET\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := detectInputFormat(varnishPath); got != "varnishlog" {
+		t.Errorf("detectInputFormat(%q) = %q, want %q", varnishPath, got, "varnishlog")
+	}
+
+	clfPath := filepath.Join(dir, "access.log")
+	if err := os.WriteFile(clfPath, []byte(`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.0" 200 2326`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := detectInputFormat(clfPath); got != "clf" {
+		t.Errorf("detectInputFormat(%q) = %q, want %q", clfPath, got, "clf")
+	}
+}
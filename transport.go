@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// transportFlags holds the CLI flags used to build the shared http.Transport
+// that every request is sent through.
+type transportFlags struct {
+	http2                 *bool
+	insecure              *bool
+	forceHTTP             *bool
+	maxIdleConns          *int
+	maxIdleConnsPerHost   *int
+	maxConnsPerHost       *int
+	idleConnTimeout       *time.Duration
+	disableKeepAlives     *bool
+	tlsHandshakeTimeout   *time.Duration
+	responseHeaderTimeout *time.Duration
+}
+
+// registerTransportFlags registers the connection-pool and HTTP/2 tuning
+// flags and returns a transportFlags to pass to newTransport once flag.Parse
+// has been called.
+func registerTransportFlags() *transportFlags {
+	return &transportFlags{
+		http2:                 flag.Bool("http2", false, "enable HTTP/2 (negotiated over TLS via ALPN)"),
+		insecure:              flag.Bool("insecure", false, "skip TLS certificate verification"),
+		forceHTTP:             flag.Bool("force-http", false, "force HTTP/1.1, disabling HTTP/2 negotiation even over TLS"),
+		maxIdleConns:          flag.Int("max-idle-conns", 100, "maximum number of idle connections across all hosts"),
+		maxIdleConnsPerHost:   flag.Int("max-idle-conns-per-host", 100, "maximum number of idle connections per host"),
+		maxConnsPerHost:       flag.Int("max-conns-per-host", 0, "maximum number of connections per host, 0 for no limit"),
+		idleConnTimeout:       flag.Duration("idle-conn-timeout", 90*time.Second, "how long an idle connection is kept in the pool"),
+		disableKeepAlives:     flag.Bool("disable-keepalives", false, "disable HTTP keep-alives, opening a new connection per request"),
+		tlsHandshakeTimeout:   flag.Duration("tls-handshake-timeout", 10*time.Second, "timeout for the TLS handshake"),
+		responseHeaderTimeout: flag.Duration("response-header-timeout", 0, "timeout waiting for response headers, 0 for no timeout"),
+	}
+}
+
+// newTransport builds the *http.Transport used for every replayed request,
+// in place of http.DefaultTransport, so that connection pool sizing and
+// HTTP/2 negotiation can be tuned to match the backend being tested.
+func newTransport(flags *transportFlags) http.RoundTripper {
+	t := &http.Transport{
+		MaxIdleConns:          *flags.maxIdleConns,
+		MaxIdleConnsPerHost:   *flags.maxIdleConnsPerHost,
+		MaxConnsPerHost:       *flags.maxConnsPerHost,
+		IdleConnTimeout:       *flags.idleConnTimeout,
+		DisableKeepAlives:     *flags.disableKeepAlives,
+		TLSHandshakeTimeout:   *flags.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: *flags.responseHeaderTimeout,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: *flags.insecure},
+	}
+
+	if *flags.forceHTTP {
+		// An empty (non-nil) TLSNextProto stops the transport from ever
+		// negotiating a protocol other than HTTP/1.1 via ALPN.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	} else if *flags.http2 {
+		if err := http2.ConfigureTransport(t); err != nil {
+			log.Printf("failed to enable HTTP/2: %s\n", err)
+		}
+	}
+
+	return t
+}
@@ -2,7 +2,7 @@
 //
 // This program takes the output from varnishlog on one server, and makes
 // identical HTTP requests to another. It uses the same headers as the
-// original requests. It does not support POST data.
+// original requests.
 //
 //
 // Requirements:
@@ -10,8 +10,45 @@
 //
 // Usage:
 // 		vlt my-host.com
+// 		vlt -compare old-host.com new-host.com
+// 		vlt -compare -diff-out ./diffs old-host.com new-host.com
+//
+// In -compare mode, every captured request is sent to both hosts
+// concurrently and the responses are diffed: status code, headers (other
+// than Date/Age/X-Varnish, see ignoredCompareHeaders) and body. Each result
+// is logged with a MATCH or DIFF tag and both latencies; -diff-out writes a
+// diff file per mismatched request.
+//
+// The connection used for replayed requests can be tuned with -http2,
+// -insecure, -force-http, -max-idle-conns, -max-idle-conns-per-host,
+// -max-conns-per-host, -idle-conn-timeout, -disable-keepalives,
+// -tls-handshake-timeout and -response-header-timeout, rather than relying
+// on http.DefaultTransport's defaults.
+//
+// Requests are replayed through a bounded worker pool rather than one
+// goroutine per request: -concurrency sets the pool size, -rps caps the
+// overall send rate, -speed replays requests preserving their original
+// inter-arrival timing (scaled by the multiplier), and -duration/
+// -max-requests cap how long or how much of the capture is replayed. SIGINT
+// stops new requests from starting but waits for in-flight ones to finish
+// and log before exiting.
+//
+// Reporting is pluggable: -stats-format selects the per-request line format
+// (text, json or csv), -stats-interval prints periodic aggregates (count,
+// error count, p50/p90/p99/p99.9 latency, RPS, bytes/sec), -metrics-addr
+// serves those same aggregates as Prometheus counters/histograms labeled by
+// method, status class and target host, and -har writes every
+// request/response pair to a HAR 1.2 archive.
+//
+// Requests don't have to come from a live varnishlog process: -input reads
+// them from a file instead, and -input-format picks how to parse it (auto,
+// the default, sniffs the file) - "varnishlog" for a captured varnishlog
+// dump, "clf" for an NCSA Common/Combined Log Format access log, or "har"
+// for a HAR 1.2 archive (including bodies and cookies).
+//
+// VLT autodetects the installed Varnish version and reads its output
+// accordingly. For Varnish 3.x:
 //
-// VLT reads output from:
 // 	varnishlog -c -o -u -i RxRequest,RxURL,RxProtocol,RxHeader,ReqEnd
 // 	-c      Include log entries which result from communication with a client.
 // 	-o      Group log entries by request ID.
@@ -34,177 +71,244 @@
 //   270 RxHeader     c Connection: keep-alive
 //   270 RxHeader     c User-Agent: Mozilla/5.0 (iPhone; CPU iPhone OS 7_1_1 like Mac OS X) AppleWebKit/537.51.2 (KHTML, like Gecko) Version/7.0 Mobile/11D201 Safari/9537.53
 //   270 ReqEnd       c 1933456148 1401232289.094973087 1401232289.121248960 0.000027418 0.026240110 0.000035763
+//
+// For Varnish 4.x and later, the equivalent "-g request" grouped tags
+// (ReqMethod/ReqURL/ReqProtocol/ReqHeader/ReqAcct/End) are used instead, and
+// ReqBody/BereqBody are captured too so that POST/PUT requests can be
+// replayed with their original body.
 
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-// The key/value string positions in varnishlog output.
-const (
-	LOG_KEY_START   int = 6
-	LOG_KEY_END     int = 19
-	LOG_VALUE_START int = 21
-)
-
-type Request struct {
-	Method   string
-	Path     string
-	Protocol string
-	Headers  *http.Header
-}
-
-func NewRequest() *Request {
-	return &Request{
-		Headers: &http.Header{},
-	}
-}
-
-func (req *Request) AddHeader(str string) {
-	header := strings.SplitN(str, ":", 2)
-	key := strings.TrimSpace(header[0])
-	value := strings.TrimSpace(header[1])
-	req.Headers.Add(key, value)
-}
-
-func (req *Request) GetHost() string {
-	return strings.TrimSpace(req.Headers.Get("Host"))
-}
+// transport is the http.RoundTripper used by every replayed request. It is
+// built in main() from the CLI transport-tuning flags, in place of
+// http.DefaultTransport, so connection pooling and HTTP/2 negotiation can be
+// adjusted to match the backend under test.
+var transport http.RoundTripper = http.DefaultTransport
 
-func (req *Request) GetURL(target_host string) (*url.URL, error) {
+// SendRequest replays req against target_host and reports the outcome to
+// rec, in place of the ad-hoc log.Printf reporting this used to do inline.
+func (req *Request) SendRequest(target_host string, rec Recorder) {
 
-	req_url, err := url.Parse(req.Path)
-	if err != nil {
-		return nil, err
-	}
-
-	if req.Protocol[0:4] == "HTTP" {
-		if len(req.Protocol) >= 5 && req.Protocol[4:5] == "S" {
-			req_url.Scheme = "https"
-		} else {
-			req_url.Scheme = "http"
-		}
-	} else {
-		err := fmt.Errorf("Unknown scheme: %s\n", req.Protocol)
-		return nil, err
+	result := RequestResult{
+		Method:     req.Method,
+		Path:       req.Path,
+		TargetHost: target_host,
+		ReqHeader:  *req.Headers,
+		ReqBody:    req.Body,
 	}
 
-	req_url.Host = target_host
-
-	return req_url, nil
-}
-
-func (req *Request) SendRequest(target_host string) {
-
 	req_url, err := req.GetURL(target_host)
 	if err != nil {
-		log.Print(err)
+		result.Err = err
+		rec.Record(result)
 		return
 	}
 
 	major, minor, ok := http.ParseHTTPVersion(req.Protocol)
 	if !ok {
-		log.Printf("Unknown protocol: %s\n", req.Protocol)
+		result.Err = fmt.Errorf("Unknown protocol: %s\n", req.Protocol)
+		rec.Record(result)
 		return
 	}
 
 	original_host := req.GetHost()
 
-	http_req := &http.Request{
-		Method:     req.Method,
-		URL:        req_url,
-		Proto:      req.Protocol,
-		ProtoMajor: major,
-		ProtoMinor: minor,
-		Header:     *req.Headers,
-		Host:       original_host,
+	http_req, err := http.NewRequest(req.Method, req_url.String(), bytes.NewReader(req.Body))
+	if err != nil {
+		result.Err = err
+		rec.Record(result)
+		return
 	}
+	http_req.Proto = req.Protocol
+	http_req.ProtoMajor = major
+	http_req.ProtoMinor = minor
+	http_req.Header = *req.Headers
+	http_req.Host = original_host
+	http_req.ContentLength = int64(len(req.Body))
 
 	start := time.Now()
 
 	// Use the lower level Transport.RoundTrip
 	// to avoid http.Client's redirect handling.
-	http_resp, err := http.DefaultTransport.RoundTrip(http_req)
-
-	elapsed := time.Since(start) / time.Millisecond
+	http_resp, err := transport.RoundTrip(http_req)
 
+	result.Elapsed = time.Since(start)
 	// Ensure that negative numbers are not displayed. This can happen in virtual
 	// machines. There is no monononic clock functionality in Go at this time, so
 	// for now I will just ensure that everything shows as 1 millisecond or more.
-	if elapsed < 1 {
-		elapsed = 1
+	if result.Elapsed < time.Millisecond {
+		result.Elapsed = time.Millisecond
 	}
 
-	if err == nil {
-		req_url.Host = original_host
-		log.Printf("[%dms] [%d] %s %s\n", elapsed, http_resp.StatusCode, req.Method, req_url)
-	} else {
-		log.Printf("[%dms] [%s] %s %s\n", elapsed, err, req.Method, req_url)
+	if err != nil {
+		result.Err = err
+		rec.Record(result)
+		return
+	}
+	defer http_resp.Body.Close()
+
+	body, err := io.ReadAll(http_resp.Body)
+	if err != nil {
+		result.Err = err
+		rec.Record(result)
+		return
 	}
 
+	result.StatusCode = http_resp.StatusCode
+	result.RespHeader = http_resp.Header
+	result.RespBody = body
+	result.RespBytes = int64(len(body))
+	rec.Record(result)
 }
 
 func main() {
 
-	if len(os.Args) != 2 {
-		fmt.Print("Usage: vlt <host>\n")
-		os.Exit(1)
+	compare := flag.Bool("compare", false, "shadow mode: send every request to both hosts and diff the responses")
+	diff_out := flag.String("diff-out", "", "directory to write per-request diff artifacts in -compare mode")
+	transport_flags := registerTransportFlags()
+	concurrency := flag.Int("concurrency", 10, "number of worker goroutines sending requests concurrently")
+	rps := flag.Float64("rps", 0, "maximum requests per second, 0 for unlimited")
+	speed := flag.Float64("speed", 0, "replay speed multiplier preserving original inter-arrival timing, 0 to disable")
+	duration := flag.Duration("duration", 0, "stop replaying after this long, 0 for unlimited")
+	max_requests := flag.Int("max-requests", 0, "stop after replaying this many requests, 0 for unlimited")
+	stats_format := flag.String("stats-format", "text", "per-request stats line format: text, json or csv")
+	stats_interval := flag.Duration("stats-interval", 0, "how often to print aggregate stats (count, error count, percentiles, RPS, bytes/sec), 0 to disable")
+	metrics_addr := flag.String("metrics-addr", "", "address to serve a Prometheus /metrics endpoint on, e.g. :9100, empty to disable")
+	har_out := flag.String("har", "", "file to write a HAR 1.2 archive of every replayed request/response pair to, empty to disable")
+	input := flag.String("input", "", "replay requests from a captured file instead of running varnishlog live")
+	input_format := flag.String("input-format", "auto", "format of -input: auto, varnishlog, clf or har")
+	flag.Usage = func() {
+		fmt.Print("Usage: vlt <host>\n       vlt -compare <old-host> <new-host>\n")
 	}
-	target_host := strings.TrimRight(strings.TrimSpace(os.Args[1]), "/")
-
-	req := NewRequest()
-
-	// Run varnishlog and parse the output. Each HTTP request is made up of
-	// multiple lines of output, starting with RxRequest and finishing with
-	// ReqEnd. When a full HTTP request has been prepared, it gets sent to
-	// the target server in a goroutine.
-	log_stdout := varnishlog()
-	log_scanner := bufio.NewScanner(log_stdout)
-	for log_scanner.Scan() {
-		line := log_scanner.Text()
-		if len(line) > LOG_VALUE_START {
-			key := strings.TrimSpace(line[LOG_KEY_START:LOG_KEY_END])
-			if key == "RxRequest" {
-				req = NewRequest()
-				req.Method = line[LOG_VALUE_START:]
-			} else if key == "RxURL" {
-				req.Path = line[LOG_VALUE_START:]
-			} else if key == "RxProtocol" {
-				req.Protocol = line[LOG_VALUE_START:]
-			} else if key == "RxHeader" {
-				req.AddHeader(line[LOG_VALUE_START:])
-			} else if key == "ReqEnd" {
-				go req.SendRequest(target_host)
-			}
+	flag.Parse()
+	args := flag.Args()
+
+	transport = newTransport(transport_flags)
+
+	dispatch_cfg := dispatchConfig{
+		concurrency: *concurrency,
+		rps:         *rps,
+		speed:       *speed,
+		maxRequests: *max_requests,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+	}
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		log.Print("received interrupt, draining in-flight requests...\n")
+		cancel()
+	}()
+
+	// Each HTTP request is made up of multiple lines of output, starting
+	// with the method tag and finishing with the end tag. When a full
+	// HTTP request has been prepared, it gets sent to a worker pool for
+	// replaying against the target server(s).
+	var source RequestSource
+	if *input == "" {
+		source = newVarnishSource(detectVarnishFormat())
+	} else {
+		resolved_format := *input_format
+		if resolved_format == "auto" {
+			resolved_format = detectInputFormat(*input)
+		}
+		switch resolved_format {
+		case "har":
+			source = newHARSource(*input)
+		case "clf":
+			source = newCLFSource(*input)
+		case "varnishlog":
+			source = newFileSource(*input, detectFileVarnishFormat(*input))
+		default:
+			log.Fatalf("unknown -input-format: %s\n", resolved_format)
 		}
 	}
-	if err := log_scanner.Err(); err != nil {
-		log.Fatal(err)
+	requests := source.Requests()
+
+	if *compare {
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		old_host := strings.TrimRight(strings.TrimSpace(args[0]), "/")
+		new_host := strings.TrimRight(strings.TrimSpace(args[1]), "/")
+
+		if *diff_out != "" {
+			if err := os.MkdirAll(*diff_out, 0755); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		var seq int64
+		dispatch(ctx, requests, dispatch_cfg, func(req *Request) {
+			n := atomic.AddInt64(&seq, 1)
+			result := req.CompareRequest(old_host, new_host)
+			tag := "MATCH"
+			if !result.match {
+				tag = "DIFF"
+			}
+			if result.err != nil {
+				log.Printf("[%s] %s %s: %s\n", tag, req.Method, req.Path, result.err)
+				return
+			}
+			log.Printf("[%s] [%dms/%dms] [%d/%d] %s %s\n", tag,
+				result.oldElapsed/time.Millisecond, result.newElapsed/time.Millisecond,
+				result.oldStatus, result.newStatus, req.Method, req.Path)
+			for _, h := range result.headerDiff {
+				log.Printf("  %s\n", h)
+			}
+			writeDiffArtifact(*diff_out, int(n), req, result)
+		})
+		return
 	}
-}
 
-func varnishlog() io.ReadCloser {
-	// Runs a varnishlog process and returns a stdout pipe for reading.
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	target_host := strings.TrimRight(strings.TrimSpace(args[0]), "/")
 
-	cmd := exec.Command("varnishlog", "-c", "-o", "-u", "-i", "RxRequest,RxURL,RxProtocol,RxHeader,ReqEnd")
+	stats := newStatsCollector(*stats_format)
+	stats_stop := make(chan struct{})
+	go stats.Run(*stats_interval, stats_stop)
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+	recorders := multiRecorder{stats}
+	if *metrics_addr != "" {
+		recorders = append(recorders, serveMetrics(*metrics_addr))
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	var har *harWriter
+	if *har_out != "" {
+		har = newHARWriter()
+		recorders = append(recorders, har)
 	}
 
-	return stdout
+	dispatch(ctx, requests, dispatch_cfg, func(req *Request) {
+		req.SendRequest(target_host, recorders)
+	})
+	close(stats_stop)
+
+	if har != nil {
+		logHARWriteError(har, *har_out)
+	}
 }